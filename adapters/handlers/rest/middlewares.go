@@ -14,7 +14,10 @@ package rest
 import (
 	"fmt"
 	"net/http"
+	"regexp"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rs/cors"
 	"github.com/semi-technologies/weaviate/adapters/handlers/rest/state"
 	"github.com/semi-technologies/weaviate/adapters/handlers/rest/swagger_middleware"
@@ -88,12 +91,147 @@ func makeSetupGlobalMiddleware(appState *state.State) func(http.Handler) http.Ha
 		handler = addPreflight(handler)
 		handler = addLiveAndReadyness(handler)
 		handler = addHandleRoot(handler)
+		handler = addRateLimitMiddleware(appState, tenantOrAPIKeyOrIP{})(handler)
+		handler = addMaxInFlight(appState)(handler)
 		handler = addModuleHandlers(handler)
+		// addTracing must wrap everything below it, including admission
+		// control and the per-source rate limiter: those are exactly the
+		// latency/rejection events this feature exists to make debuggable,
+		// and neither has a span yet by the time it runs if tracing sits
+		// further in.
+		handler = addTracing(handler)
 
 		return handler
 	}
 }
 
+// requestsRejectedTotal counts requests rejected by admission control, by
+// reason, so operators can tell a concurrency-limit rejection apart from
+// e.g. an auth or rate-limit rejection in the same dashboard.
+var requestsRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "weaviate_requests_rejected_total",
+	Help: "Number of requests rejected before being handled",
+}, []string{"reason"})
+
+// longRunningRequestPaths exempts the batch endpoints, which are expected to
+// hold a connection open for a long time, from the in-flight cap: counting
+// them against the same budget as short requests would starve the latter
+// without actually protecting the node, since these endpoints already bound
+// their own resource usage. Only /v1/batch and paths below it match; reads
+// such as /v1/objects are counted against the cap whatever their limit.
+var longRunningRequestPaths = regexp.MustCompile(`^/v1/batch(/.*)?$`)
+
+// exemptFromAdmissionControl also excludes health checks, the swagger
+// document and the API root, none of which do real work and all of which
+// need to stay reachable for liveness/readiness probes even while the
+// node is shedding load.
+func exemptFromAdmissionControl(r *http.Request) bool {
+	if longRunningRequestPaths.MatchString(r.URL.Path) {
+		return true
+	}
+	switch r.URL.Path {
+	case "/", "/v1/.well-known/live", "/v1/.well-known/ready", "/v1/.well-known/openid-configuration", "/swagger.json":
+		return true
+	default:
+		return false
+	}
+}
+
+// addMaxInFlight rejects requests with 429 once too many are being served
+// concurrently, so a traffic spike fails fast instead of exhausting
+// goroutines and memory on expensive vector queries. Reads and writes (as
+// determined by HTTP method) are tracked against separate budgets, since a
+// burst of writes shouldn't be able to starve reads or vice versa.
+//
+// MaxRequestsInFlight and MaxMutatingRequestsInFlight are expected to be
+// populated from the MAX_REQUESTS_IN_FLIGHT / MAX_MUTATING_REQUESTS_IN_FLIGHT
+// env vars by usecases/config's environment parsing, same as every other
+// ServerConfig.Config field; a limit left at its zero value disables that
+// budget (see newInFlightSemaphore) rather than rejecting everything. With
+// MaxRequestsInFlight at zero, reads are not limited; with
+// MaxMutatingRequestsInFlight at zero, writes are counted against the read
+// budget instead.
+func addMaxInFlight(appState *state.State) func(http.Handler) http.Handler {
+	maxRead := appState.ServerConfig.Config.MaxRequestsInFlight
+	maxWrite := appState.ServerConfig.Config.MaxMutatingRequestsInFlight
+
+	readSem := newInFlightSemaphore(maxRead)
+	writeSem := newInFlightSemaphore(maxWrite)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if readSem == nil && writeSem == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if exemptFromAdmissionControl(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			sem := readSem
+			if isMutatingMethod(r.Method) && writeSem != nil {
+				sem = writeSem
+			}
+			if sem == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !sem.tryAcquire() {
+				requestsRejectedTotal.WithLabelValues("concurrency").Inc()
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				w.Write([]byte(`{"error":[{"message":"too many requests in flight, please retry later"}]}`))
+				return
+			}
+			defer sem.release()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func isMutatingMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// inFlightSemaphore is a non-blocking counting semaphore: acquiring past
+// its capacity fails immediately rather than queueing, since a queued
+// request is exactly the resource exhaustion admission control exists to
+// prevent.
+type inFlightSemaphore struct {
+	slots chan struct{}
+}
+
+// newInFlightSemaphore returns nil if max is not a positive limit, so
+// addMaxInFlight can skip the check entirely for an unconfigured budget.
+func newInFlightSemaphore(max int) *inFlightSemaphore {
+	if max <= 0 {
+		return nil
+	}
+	return &inFlightSemaphore{slots: make(chan struct{}, max)}
+}
+
+func (s *inFlightSemaphore) tryAcquire() bool {
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *inFlightSemaphore) release() {
+	<-s.slots
+}
+
 func makeAddLogging(logger logrus.FieldLogger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
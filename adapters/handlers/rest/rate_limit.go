@@ -0,0 +1,289 @@
+//                           _       _
+// __      _____  __ ___   ___  __ _| |_ ___
+// \ \ /\ / / _ \/ _` \ \ / / |/ _` | __/ _ \
+//  \ V  V /  __/ (_| |\ V /| | (_| | ||  __/
+//   \_/\_/ \___|\__,_| \_/ |_|\__,_|\__\___|
+//
+//  Copyright © 2016 - 2020 SeMI Technologies B.V. All rights reserved.
+//
+//  CONTACT: hello@semi.technology
+//
+
+package rest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/semi-technologies/weaviate/adapters/handlers/rest/state"
+	"golang.org/x/time/rate"
+)
+
+// maxRateLimitSources bounds how many distinct sources (IPs, API keys,
+// tenants) are tracked at once, so an attacker cycling through source
+// identities cannot grow our memory usage without bound.
+const maxRateLimitSources = 65536
+
+// rateLimitSourceTTL is how long a source can sit idle before its limiter
+// is evicted, freeing the budget for new sources.
+const rateLimitSourceTTL = 10 * time.Minute
+
+// rateLimitRejectedTotal is separate from requestsRejectedTotal's
+// "concurrency" reason so operators can tell a slow/abusive client apart
+// from a node that is simply out of capacity.
+var rateLimitRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "weaviate_rate_limit_rejected_total",
+	Help: "Number of requests rejected by the per-source rate limiter",
+}, []string{"source_type"})
+
+// SourceExtractor identifies which bucket a request's rate limit should be
+// charged against, and whether that source is anonymous (so it can be
+// held to a stricter quota than an authenticated one).
+type SourceExtractor interface {
+	// Extract returns the source key and whether the request is
+	// anonymous. An empty key means "don't rate limit this request".
+	Extract(r *http.Request) (source string, anonymous bool)
+	// Name identifies the extractor for metrics, e.g. "ip", "api_key".
+	Name() string
+}
+
+// tenantOrAPIKeyOrIP picks a tenant name from the URL if this looks like a
+// multi-tenant collection request, otherwise falls back to a hash of the
+// Authorization header, and finally to the client IP. Requests from the
+// same client hitting different tenants are rate limited independently,
+// which matches how operators reason about "noisy tenant" incidents.
+//
+// Anonymous vs. authenticated is guessed from the presence of an
+// Authorization header rather than read from appState.AnonymousAccess's
+// actual auth decision: that middleware is wired into makeSetupMiddlewares,
+// which runs after routing, binding and validation, while this extractor
+// runs inside makeSetupGlobalMiddleware, much earlier in the chain. By the
+// time a request reaches here, AnonymousAccess hasn't decided anything
+// yet, so there's nothing to integrate with at this point. The downside is
+// real: a request carrying an invalid or expired key is treated as
+// authenticated even though AnonymousAccess would later reject it, giving
+// it the authenticated quota it arguably shouldn't get.
+type tenantOrAPIKeyOrIP struct{}
+
+func (tenantOrAPIKeyOrIP) Name() string { return "tenant_or_api_key_or_ip" }
+
+func (tenantOrAPIKeyOrIP) Extract(r *http.Request) (string, bool) {
+	if tenant := r.URL.Query().Get("tenant"); tenant != "" {
+		return "tenant:" + tenant, false
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		sum := sha256.Sum256([]byte(auth))
+		return "key:" + hex.EncodeToString(sum[:]), false
+	}
+	if ip := clientIP(r); ip != "" {
+		return "ip:" + ip, true
+	}
+	return "", true
+}
+
+// clientIP prefers the left-most address in X-Forwarded-For, set by the
+// proxy closest to the original client, falling back to the immediate
+// peer address when the request didn't go through a proxy.
+func clientIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		if first, _, found := strings.Cut(fwd, ","); found {
+			return strings.TrimSpace(first)
+		}
+		return strings.TrimSpace(fwd)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RateLimitSettings configures addRateLimitMiddleware. Authenticated and
+// anonymous traffic get independent rate/burst budgets so, for example,
+// an API-key-holding integration isn't throttled down to the quota meant
+// to protect against anonymous abuse.
+type RateLimitSettings struct {
+	Enabled bool
+
+	Rate     float64 // requests per second
+	Burst    int
+	MaxDelay time.Duration
+
+	AnonymousRate  float64
+	AnonymousBurst int
+}
+
+// rateLimitExemptPaths excludes only health checks, the swagger document
+// and the API root from per-source rate limiting - endpoints that do no
+// real work and must stay reachable for liveness/readiness probes even
+// while a source is being throttled. Unlike exemptFromAdmissionControl
+// (see middlewares.go), this deliberately does NOT exempt /v1/batch: bulk
+// ingestion is exactly the abusive-client traffic this limiter exists to
+// defend against, so it must not inherit admission control's carve-out
+// for long-running requests.
+func rateLimitExempt(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/", "/v1/.well-known/live", "/v1/.well-known/ready", "/v1/.well-known/openid-configuration", "/swagger.json":
+		return true
+	default:
+		return false
+	}
+}
+
+// addRateLimitMiddleware delays or rejects requests once a source (tenant,
+// API key or IP, per extractor) exceeds its configured rate. A request
+// that would need to wait longer than MaxDelay is rejected with 429
+// instead of being delayed, so it fails fast rather than piling up.
+//
+// RateLimit is expected to be populated from RATE_LIMIT_ENABLED and
+// friends by usecases/config's environment parsing; with it left at its
+// zero value, cfg.Enabled is false and this middleware is a no-op.
+func addRateLimitMiddleware(appState *state.State, extractor SourceExtractor) func(http.Handler) http.Handler {
+	cfg := appState.ServerConfig.Config.RateLimit
+	if !cfg.Enabled {
+		return func(next http.Handler) http.Handler { return next }
+	}
+
+	authenticated := newTTLLimiterMap(maxRateLimitSources, rateLimitSourceTTL, func() *rate.Limiter {
+		return rate.NewLimiter(rate.Limit(cfg.Rate), cfg.Burst)
+	})
+	anonymous := newTTLLimiterMap(maxRateLimitSources, rateLimitSourceTTL, func() *rate.Limiter {
+		return rate.NewLimiter(rate.Limit(cfg.AnonymousRate), cfg.AnonymousBurst)
+	})
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if rateLimitExempt(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			source, isAnonymous := extractor.Extract(r)
+			if source == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			sources := authenticated
+			if isAnonymous {
+				sources = anonymous
+			}
+			limiter := sources.get(source)
+
+			reservation := limiter.Reserve()
+			if !reservation.OK() {
+				rateLimitRejectedTotal.WithLabelValues(extractor.Name()).Inc()
+				rejectRateLimited(w)
+				return
+			}
+			if delay := reservation.Delay(); delay > 0 {
+				if delay > cfg.MaxDelay {
+					reservation.Cancel()
+					rateLimitRejectedTotal.WithLabelValues(extractor.Name()).Inc()
+					rejectRateLimited(w)
+					return
+				}
+				time.Sleep(delay)
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func rejectRateLimited(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte(`{"error":[{"message":"rate limit exceeded, please retry later"}]}`))
+}
+
+// ttlLimiterMap is a bounded, TTL-evicted cache of rate.Limiters, one per
+// source. Sources that stay idle past the TTL are swept so long-lived
+// deployments don't accumulate a limiter per IP/tenant/API key ever seen.
+type ttlLimiterMap struct {
+	mu         sync.Mutex
+	entries    map[string]*ttlLimiterEntry
+	maxEntries int
+	ttl        time.Duration
+	newLimiter func() *rate.Limiter
+}
+
+type ttlLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+func newTTLLimiterMap(maxEntries int, ttl time.Duration, newLimiter func() *rate.Limiter) *ttlLimiterMap {
+	m := &ttlLimiterMap{
+		entries:    make(map[string]*ttlLimiterEntry),
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		newLimiter: newLimiter,
+	}
+	go m.sweepLoop()
+	return m
+}
+
+func (m *ttlLimiterMap) sweepLoop() {
+	ticker := time.NewTicker(m.ttl / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.sweep()
+	}
+}
+
+func (m *ttlLimiterMap) sweep() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for source, entry := range m.entries {
+		if now.Sub(entry.lastUsed) > m.ttl {
+			delete(m.entries, source)
+		}
+	}
+}
+
+func (m *ttlLimiterMap) get(source string) *rate.Limiter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if entry, ok := m.entries[source]; ok {
+		entry.lastUsed = time.Now()
+		return entry.limiter
+	}
+
+	if len(m.entries) >= m.maxEntries {
+		m.evictOldestLocked()
+	}
+
+	entry := &ttlLimiterEntry{limiter: m.newLimiter(), lastUsed: time.Now()}
+	m.entries[source] = entry
+	return entry.limiter
+}
+
+// evictOldestLocked makes room for a new source once maxEntries is
+// reached. A linear scan is fine here: it only runs once the map is full,
+// which an operator sizing maxEntries for their expected cardinality
+// should rarely hit in steady state.
+func (m *ttlLimiterMap) evictOldestLocked() {
+	var oldestSource string
+	var oldestTime time.Time
+
+	for source, entry := range m.entries {
+		if oldestSource == "" || entry.lastUsed.Before(oldestTime) {
+			oldestSource = source
+			oldestTime = entry.lastUsed
+		}
+	}
+	if oldestSource != "" {
+		delete(m.entries, oldestSource)
+	}
+}
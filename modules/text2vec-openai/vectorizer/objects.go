@@ -22,6 +22,10 @@ import (
 
 	"github.com/pkg/errors"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/weaviate/tiktoken-go"
 
 	"github.com/weaviate/weaviate/modules/text2vec-openai/clients"
@@ -29,6 +33,7 @@ import (
 	"github.com/weaviate/weaviate/entities/models"
 	"github.com/weaviate/weaviate/entities/moduletools"
 	"github.com/weaviate/weaviate/modules/text2vec-openai/ent"
+	"github.com/weaviate/weaviate/usecases/modulecomponents/ratelimit"
 	objectsvectorizer "github.com/weaviate/weaviate/usecases/modulecomponents/vectorizer"
 	libvectorizer "github.com/weaviate/weaviate/usecases/vectorizer"
 )
@@ -41,6 +46,12 @@ const (
 	OpenAiMaxTimePerBatch = float64(10)
 )
 
+// tracer is shared by ObjectBatch and batchWorker so that the "queue-wait",
+// "rate-limit-wait" and per-request spans they create all nest under
+// whatever span is already present on the caller's context (typically the
+// REST handler's request span), rather than starting an orphan trace.
+var tracer = otel.Tracer("github.com/weaviate/weaviate/modules/text2vec-openai/vectorizer")
+
 type batchJob struct {
 	texts      []string
 	tokens     []int
@@ -50,7 +61,20 @@ type batchJob struct {
 	cfg        moduletools.ClassConfig
 	vecs       [][]float32
 	skipObject []bool
-	startTime  time.Time
+	// requestTime is captured once, when ObjectBatch enqueues the job, and
+	// is the single authoritative clock batchWorker and makeRequest use for
+	// this job's deadline, reset-window and refill arithmetic. Using it
+	// consistently - rather than a fresh time.Now() taken later by whichever
+	// goroutine happens to process the job - matters once jobs queue up:
+	// without it, a job that waited behind others in jobQueueCh would have
+	// its budget judged against a "now" far later than when it was
+	// actually submitted, failing it with "will not refresh in time" even
+	// though it had plenty of its own deadline left.
+	requestTime time.Time
+	// queueSpan covers the time between ObjectBatch enqueueing the job and
+	// batchWorker picking it up; it is ended as soon as the worker starts
+	// processing it.
+	queueSpan trace.Span
 }
 
 type Vectorizer struct {
@@ -58,6 +82,17 @@ type Vectorizer struct {
 	objectVectorizer *objectsvectorizer.ObjectVectorizer
 	jobQueueCh       chan batchJob
 	maxBatchTime     time.Duration
+
+	bucketsMu sync.Mutex
+	buckets   map[string]*ratelimit.TokenBucket
+
+	// cluster, when set via SetClusterLimiter, additionally arbitrates the
+	// case a single item alone exceeds this node's locally observed budget
+	// (see batchWorker's Reserve branch) through a cluster-wide bucket
+	// owner, so two nodes racing the same provider quota can't both decide
+	// independently that they have headroom. Left nil, the default, rate
+	// limiting is exactly what it was before: per-node TokenBuckets only.
+	cluster *ratelimit.ClusterLimiter
 }
 
 func New(client Client, maxBatchTime time.Duration, logger logrus.FieldLogger) *Vectorizer {
@@ -66,20 +101,96 @@ func New(client Client, maxBatchTime time.Duration, logger logrus.FieldLogger) *
 		objectVectorizer: objectsvectorizer.New(),
 		jobQueueCh:       make(chan batchJob, BatchChannelSize),
 		maxBatchTime:     maxBatchTime,
+		buckets:          make(map[string]*ratelimit.TokenBucket),
 	}
 
 	enterrors.GoWrapper(func() { vec.batchWorker() }, logger)
 	return vec
 }
 
+// SetClusterLimiter opts this Vectorizer into cluster-wide rate limit
+// enforcement: once set, an item that doesn't fit this node's locally
+// observed budget (batchWorker's Reserve branch) is additionally
+// arbitrated through cluster before being admitted, and every real
+// upstream response is reported to it alongside the local TokenBucket, so
+// every node sharing one provider quota converges on the same view of it
+// instead of each under-counting its peers' usage.
+//
+// There is no in-tree ratelimit.PeerClient to build a ClusterLimiter from
+// yet (see usecases/modulecomponents/ratelimit/cluster.go) - the gRPC one
+// depended on generated protobuf bindings that were never checked in.
+// Callers that want this need their own PeerClient plus a
+// ratelimit.NodeSelector backed by their cluster.State. Leaving this
+// unset, the default, keeps today's per-node-only enforcement.
+func (v *Vectorizer) SetClusterLimiter(cluster *ratelimit.ClusterLimiter) {
+	v.cluster = cluster
+}
+
+// clusterBucketKeyProvider identifies this module's provider to the shared
+// ratelimit.BucketKey namespace: every VectorizationConfig this package
+// builds talks to OpenAI or an Azure OpenAI deployment, never a different
+// provider, so the provider component is constant here.
+const clusterBucketKeyProvider = "openai"
+
+func clusterBucketKeyFor(conf ent.VectorizationConfig) ratelimit.BucketKey {
+	return ratelimit.BucketKey{Provider: clusterBucketKeyProvider, APIKey: conf.APIKey, Model: conf.Model}
+}
+
+// bucketFor returns the TokenBucket that tracks the provider quota for the
+// class config's model/deployment, creating it with the algorithm the
+// class requests (`rateLimitAlgorithm`) on first use. Classes that share a
+// model/deployment, but disagree on the algorithm, keep the algorithm
+// chosen by whichever class is vectorized first - picking an algorithm is
+// a deployment-wide choice in practice, since they all share one quota.
+func (v *Vectorizer) bucketFor(cfg moduletools.ClassConfig, conf ent.VectorizationConfig) *ratelimit.TokenBucket {
+	// Include a fingerprint of the API key: two classes that otherwise
+	// share a model/deployment but authenticate with different keys do not
+	// share a quota, and bucketing them together would have one tenant's
+	// observed rate-limit headers throttle another tenant's unrelated
+	// budget.
+	key := fmt.Sprintf("%s/%s/%s/%s/%s", conf.Model, conf.ResourceName, conf.DeploymentID, conf.BaseURL,
+		ratelimit.Fingerprint(conf.APIKey))
+
+	v.bucketsMu.Lock()
+	defer v.bucketsMu.Unlock()
+
+	if b, ok := v.buckets[key]; ok {
+		return b
+	}
+
+	algorithm, err := ratelimit.ParseAlgorithm(NewClassSettings(cfg).RateLimitAlgorithm())
+	if err != nil {
+		algorithm = ratelimit.TokenBucketAlgorithm
+	}
+	b := ratelimit.NewTokenBucket(algorithm)
+	v.buckets[key] = b
+	return b
+}
+
+// Client's concrete implementation lives in modules/text2vec-openai/clients
+// (not part of this checkout); it must accept the requestTime parameter
+// below for Vectorize to compile.
 type Client interface {
+	// requestTime is the time the caller considers this request to have
+	// started - for batched calls, when the batch was enqueued, not when
+	// the client got around to dialing out - so that rate-limit windows
+	// reported back are anchored to it rather than to the moment the
+	// network call actually fired.
 	Vectorize(ctx context.Context, input []string,
-		config ent.VectorizationConfig) (*ent.VectorizationResult, *ent.RateLimits, error)
+		config ent.VectorizationConfig, requestTime time.Time) (*ent.VectorizationResult, *ent.RateLimits, error)
 	VectorizeQuery(ctx context.Context, input []string,
 		config ent.VectorizationConfig) (*ent.VectorizationResult, error)
 }
 
 // IndexCheck returns whether a property of a class should be indexed
+//
+// ClassSettings' concrete implementation and its NewClassSettings
+// constructor, like Client's above, live outside this checkout; the real
+// one must grow two additions for the rate-limiting work in this package
+// to compile: ApiKey, the per-class override bucketFor fingerprints into
+// its TokenBucket key, and RateLimitAlgorithm, which selects the
+// TokenBucket behavior (see usecases/modulecomponents/ratelimit.Algorithm)
+// to use once a class's quota is exhausted.
 type ClassSettings interface {
 	PropertyIndexed(property string) bool
 	VectorizePropertyName(propertyName string) bool
@@ -91,6 +202,8 @@ type ClassSettings interface {
 	DeploymentID() string
 	BaseURL() string
 	IsAzure() bool
+	RateLimitAlgorithm() string
+	ApiKey() string
 }
 
 func (v *Vectorizer) Object(ctx context.Context, object *models.Object, cfg moduletools.ClassConfig,
@@ -102,7 +215,7 @@ func (v *Vectorizer) Object(ctx context.Context, object *models.Object, cfg modu
 func (v *Vectorizer) object(ctx context.Context, object *models.Object, cfg moduletools.ClassConfig,
 ) ([]float32, error) {
 	text := v.objectVectorizer.Texts(ctx, object, NewClassSettings(cfg))
-	res, _, err := v.client.Vectorize(ctx, []string{text}, v.getVectorizationConfig(cfg))
+	res, _, err := v.client.Vectorize(ctx, []string{text}, v.getVectorizationConfig(cfg), time.Now())
 	if err != nil {
 		return nil, err
 	}
@@ -124,6 +237,7 @@ func (v *Vectorizer) getVectorizationConfig(cfg moduletools.ClassConfig) ent.Vec
 		BaseURL:      settings.BaseURL(),
 		IsAzure:      settings.IsAzure(),
 		Dimensions:   settings.Dimensions(),
+		APIKey:       settings.ApiKey(),
 	}
 }
 
@@ -135,14 +249,14 @@ func (v *Vectorizer) getVectorizationConfig(cfg moduletools.ClassConfig) ent.Vec
 //     batches are not mixed with each other to simplify returning the vectors.
 //  3. It sends the smaller batches to the vectorizer
 func (v *Vectorizer) batchWorker() {
-	rateLimit := &ent.RateLimits{}
 	texts := make([]string, 0, 100)
 	origIndex := make([]int, 0, 100)
-	firstRequest := true
 	timePerToken := 0.0
 	batchTookInS := float64(0)
 
 	for job := range v.jobQueueCh {
+		job.queueSpan.End()
+
 		// the total batch should not take longer than 60s to avoid timeouts. We will only use 40s here to be safe
 
 		objCounter := 0
@@ -151,17 +265,20 @@ func (v *Vectorizer) batchWorker() {
 		origIndex = origIndex[:0]
 
 		conf := v.getVectorizationConfig(job.cfg)
+		bucket := v.bucketFor(job.cfg, conf)
+		limits := bucket.Snapshot()
 
 		// we don't know the current rate limits without a request => send a small one
-		for objCounter < len(job.texts) && firstRequest {
-			var err error
+		for objCounter < len(job.texts) && limits.LimitTokens == 0 {
 			if !job.skipObject[objCounter] {
-				rateLimit, err = v.makeRequest(job, job.texts[objCounter:objCounter+1], conf, []int{objCounter})
+				rateLimit, err := v.makeRequest(job, job.texts[objCounter:objCounter+1], conf, []int{objCounter}, job.requestTime)
 				if err != nil {
 					job.errs[objCounter] = err
+					objCounter++
 					continue
 				}
-				firstRequest = false
+				v.observeRateLimits(job.ctx, conf, bucket, rateLimit)
+				limits = bucket.Snapshot()
 			}
 			objCounter++
 		}
@@ -181,7 +298,7 @@ func (v *Vectorizer) batchWorker() {
 				continue
 			}
 
-			if job.tokens[objCounter] > rateLimit.LimitTokens {
+			if job.tokens[objCounter] > limits.LimitTokens {
 				job.errs[objCounter] = fmt.Errorf("text too long for vectorization")
 				objCounter++
 				continue
@@ -189,7 +306,7 @@ func (v *Vectorizer) batchWorker() {
 
 			// add objects to the current vectorizer-batch until the remaining tokens are used up or other limits are reached
 			text := job.texts[objCounter]
-			if float32(tokensInCurrentBatch+job.tokens[objCounter]) < 0.95*float32(rateLimit.RemainingTokens) && (timePerToken*float64(tokensInCurrentBatch) < OpenAiMaxTimePerBatch) && len(texts) < MaxObjectsPerBatch {
+			if float32(tokensInCurrentBatch+job.tokens[objCounter]) < 0.95*float32(limits.RemainingTokens) && (timePerToken*float64(tokensInCurrentBatch) < OpenAiMaxTimePerBatch) && len(texts) < MaxObjectsPerBatch {
 				tokensInCurrentBatch += job.tokens[objCounter]
 				texts = append(texts, text)
 				origIndex = append(origIndex, objCounter)
@@ -199,34 +316,65 @@ func (v *Vectorizer) batchWorker() {
 				}
 			}
 
-			// if a single object is larger than the current token limit we need to wait until the token limit refreshes
-			// enough to be able to handle the object. This assumes that the tokenLimit refreshes linearly which is true
-			// for openAI, but needs to be checked for other providers
-			if len(texts) == 0 && rateLimit.ResetTokens > 0 {
-				fractionOfTotalLimit := float32(job.tokens[objCounter]) / float32(rateLimit.LimitTokens)
-				sleepTime := time.Duration(float32(rateLimit.ResetTokens)*fractionOfTotalLimit+1) * time.Second
-				if time.Since(job.startTime)+sleepTime < v.maxBatchTime {
-					time.Sleep(sleepTime)
-					rateLimit.RemainingTokens += int(float32(rateLimit.LimitTokens) * fractionOfTotalLimit)
-				} else {
-					job.errs[objCounter] = fmt.Errorf("text too long for vectorization. Cannot wait for token refresh due to time limit")
+			// the object alone is larger than the remaining budget: ask the bucket what to do about it. Depending on
+			// the configured algorithm this either waits for enough of the budget to refill, or (drainOverLimit)
+			// depletes the bucket and lets us submit right away.
+			if len(texts) == 0 {
+				_, waitSpan := tracer.Start(job.ctx, "rate-limit-wait",
+					trace.WithAttributes(attribute.Int("tokens", job.tokens[objCounter])))
+				deadline := job.requestTime.Add(v.maxBatchTime)
+
+				if v.cluster != nil {
+					// Ask the cluster-wide owner before this node's own
+					// TokenBucket: it's exactly this node-exhausted-its-local-
+					// budget case where another node could otherwise grant
+					// itself the same tokens out of a quota they both share.
+					if _, err := v.cluster.Reserve(job.ctx, clusterBucketKeyFor(conf), job.tokens[objCounter], deadline); err != nil {
+						waitSpan.RecordError(err)
+						waitSpan.End()
+						job.errs[objCounter] = err
+						objCounter++
+						continue
+					}
+				}
+
+				wait, err := bucket.Reserve(job.tokens[objCounter], job.requestTime, deadline)
+				if err != nil {
+					waitSpan.RecordError(err)
+					waitSpan.End()
+					job.errs[objCounter] = err
 					objCounter++
+					continue
 				}
-				continue // try again or next item
+				if wait > 0 {
+					time.Sleep(wait)
+				}
+				waitSpan.End()
+				limits = bucket.Snapshot()
+				if float32(job.tokens[objCounter]) < 0.95*float32(limits.RemainingTokens) {
+					continue // try again with the refreshed budget
+				}
+				// drainOverLimit left the bucket empty: send this item on its own right away
+				tokensInCurrentBatch = job.tokens[objCounter]
+				texts = append(texts, job.texts[objCounter])
+				origIndex = append(origIndex, objCounter)
+				objCounter++
 			}
 
 			start := time.Now()
-			rateLimitNew, _ := v.makeRequest(job, texts, conf, origIndex)
+			rateLimitNew, _ := v.makeRequest(job, texts, conf, origIndex, job.requestTime)
 			batchTookInS = time.Since(start).Seconds()
 			timePerToken = batchTookInS / float64(tokensInCurrentBatch)
 			if rateLimitNew != nil {
-				rateLimit = rateLimitNew
+				v.observeRateLimits(job.ctx, conf, bucket, rateLimitNew)
 			}
+			limits = bucket.Snapshot()
+
 			// not all request limits are included in "RemainingRequests" and "ResetRequests". For example, in the free
 			// tier only the RPD limits are shown but not RPM
-			if rateLimit.RemainingRequests == 0 && rateLimit.ResetRequests > 0 {
+			if limits.RemainingRequests == 0 && limits.ResetRequests > 0 {
 				// if we need to wait more than MaxBatchTime for a reset we need to stop the batch to not produce timeouts
-				if time.Since(job.startTime)+time.Duration(rateLimit.ResetRequests)*time.Second > v.maxBatchTime {
+				if job.requestTime.Add(limits.ResetRequests).After(job.requestTime.Add(v.maxBatchTime)) {
 					for j := origIndex[0]; j < len(job.texts); j++ {
 						if !job.skipObject[j] {
 							job.errs[j] = errors.New("request rate limit exceeded and will not refresh in time")
@@ -234,7 +382,7 @@ func (v *Vectorizer) batchWorker() {
 					}
 					break
 				}
-				time.Sleep(time.Duration(rateLimit.ResetRequests) * time.Second)
+				time.Sleep(limits.ResetRequests)
 			}
 
 			// reset for next vectorizer-batch
@@ -246,9 +394,9 @@ func (v *Vectorizer) batchWorker() {
 		// in case we exit the loop without sending the last batch. This can happen when the last object is a skip or
 		// is too long
 		if len(texts) > 0 && objCounter == len(job.texts) {
-			rateLimitNew, _ := v.makeRequest(job, texts, conf, origIndex)
+			rateLimitNew, _ := v.makeRequest(job, texts, conf, origIndex, job.requestTime)
 			if rateLimitNew != nil {
-				rateLimit = rateLimitNew
+				v.observeRateLimits(job.ctx, conf, bucket, rateLimitNew)
 			}
 		}
 
@@ -257,14 +405,63 @@ func (v *Vectorizer) batchWorker() {
 	}
 }
 
+// fromEntRateLimits converts the provider-specific rate limit headers
+// (seconds-based, as reported by OpenAI) into the ratelimit package's
+// duration-based representation.
+func fromEntRateLimits(rl *ent.RateLimits) ratelimit.RateLimits {
+	return ratelimit.RateLimits{
+		RemainingTokens:   rl.RemainingTokens,
+		RemainingRequests: rl.RemainingRequests,
+		LimitTokens:       rl.LimitTokens,
+		LimitRequests:     rl.LimitRequests,
+		ResetTokens:       time.Duration(rl.ResetTokens) * time.Second,
+		ResetRequests:     time.Duration(rl.ResetRequests) * time.Second,
+	}
+}
+
+// observeRateLimits records a real upstream response's rate-limit headers
+// against this node's local bucket, and, when cluster-wide enforcement is
+// enabled, against the cluster owner too, so every node's view of a shared
+// quota converges on what the provider actually reported rather than each
+// node only ever seeing its own slice of traffic. The cluster report is
+// best-effort: losing one node's worth of freshness doesn't break
+// correctness, since the next real call reports again.
+func (v *Vectorizer) observeRateLimits(ctx context.Context, conf ent.VectorizationConfig, bucket *ratelimit.TokenBucket, rl *ent.RateLimits) {
+	limits := fromEntRateLimits(rl)
+	bucket.Observe(limits)
+	if v.cluster != nil {
+		_ = v.cluster.Observe(ctx, clusterBucketKeyFor(conf), limits)
+	}
+}
+
 func (v *Vectorizer) makeRequest(job batchJob, texts []string, conf ent.VectorizationConfig, origIndex []int,
+	requestTime time.Time,
 ) (*ent.RateLimits, error) {
-	res, rateLimit, err := v.client.Vectorize(job.ctx, texts, conf)
+	totalTokens := 0
+	for _, i := range origIndex {
+		totalTokens += job.tokens[i]
+	}
+
+	ctx, span := tracer.Start(job.ctx, "vectorize", trace.WithAttributes(
+		attribute.String("model", conf.Model),
+		attribute.Int("batch_size", len(texts)),
+		attribute.Int("tokens", totalTokens),
+	))
+	defer span.End()
+
+	res, rateLimit, err := v.client.Vectorize(ctx, texts, conf, requestTime)
 	if err != nil {
+		span.RecordError(err)
 		for j := 0; j < len(texts); j++ {
 			job.errs[origIndex[j]] = err
 		}
 	} else {
+		if rateLimit != nil {
+			span.SetAttributes(
+				attribute.Int("remaining_tokens", rateLimit.RemainingTokens),
+				attribute.Int("reset_seconds", rateLimit.ResetTokens),
+			)
+		}
 		for j := 0; j < len(texts); j++ {
 			if res.Errors[j] != nil {
 				job.errs[origIndex[j]] = res.Errors[j]
@@ -303,6 +500,8 @@ func (v *Vectorizer) ObjectBatch(ctx context.Context, objects []*models.Object,
 	}
 
 	// prepare input for vectorizer, and send it to the queue. Prepare here to avoid work in the queue-worker
+	_, tokenizeSpan := tracer.Start(ctx, "token-estimate",
+		trace.WithAttributes(attribute.Int("object_count", len(objects))))
 	skipAll := true
 	for i := range objects {
 		if skipObject[i] {
@@ -313,21 +512,24 @@ func (v *Vectorizer) ObjectBatch(ctx context.Context, objects []*models.Object,
 		texts[i] = text
 		tokens[i] = clients.GetTokensCount(conf.Model, text, tke)
 	}
+	tokenizeSpan.End()
 
 	if skipAll {
 		return vecs, errs
 	}
 
+	_, queueSpan := tracer.Start(ctx, "queue-wait")
 	v.jobQueueCh <- batchJob{
-		ctx:        ctx,
-		wg:         &wg,
-		errs:       errs,
-		cfg:        cfg,
-		texts:      texts,
-		tokens:     tokens,
-		vecs:       vecs,
-		skipObject: skipObject,
-		startTime:  time.Now(),
+		ctx:         ctx,
+		wg:          &wg,
+		errs:        errs,
+		cfg:         cfg,
+		texts:       texts,
+		tokens:      tokens,
+		vecs:        vecs,
+		skipObject:  skipObject,
+		requestTime: time.Now(),
+		queueSpan:   queueSpan,
 	}
 
 	wg.Wait()
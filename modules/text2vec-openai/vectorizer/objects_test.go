@@ -0,0 +1,123 @@
+//                           _       _
+// __      _____  __ ___   ___  __ _| |_ ___
+// \ \ /\ / / _ \/ _` \ \ / / |/ _` | __/ _ \
+//  \ V  V /  __/ (_| |\ V /| | (_| | ||  __/
+//   \_/\_/ \___|\__,_| \_/ |_|\__,_|\__\___|
+//
+//  Copyright © 2016 - 2024 Weaviate B.V. All rights reserved.
+//
+//  CONTACT: hello@weaviate.io
+//
+
+package vectorizer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaviate/weaviate/entities/models"
+	"github.com/weaviate/weaviate/modules/text2vec-openai/ent"
+)
+
+// fakeClassConfig carries no per-class settings, which is all bucketFor and
+// NewClassSettings need for this test: every field they read defaults to its
+// zero value, so every batch shares one model/deployment key and therefore
+// one TokenBucket.
+type fakeClassConfig struct{}
+
+func (fakeClassConfig) Class() map[string]interface{}          { return nil }
+func (fakeClassConfig) Tenant() string                         { return "" }
+func (fakeClassConfig) Property(string) map[string]interface{} { return nil }
+func (fakeClassConfig) TargetVector() string                   { return "" }
+
+// slowFakeClient is a deterministic Client that takes a little time per
+// call and always reports a one-second reset window. A worker that judges a
+// job's deadline against time.Now() instead of the job's own requestTime
+// would, once enough calls have queued up behind each other, wrongly decide
+// a later job can't refresh its budget in time.
+type slowFakeClient struct {
+	mu      sync.Mutex
+	calls   int
+	perCall time.Duration
+}
+
+func (f *slowFakeClient) Vectorize(ctx context.Context, input []string, config ent.VectorizationConfig,
+	requestTime time.Time,
+) (*ent.VectorizationResult, *ent.RateLimits, error) {
+	f.mu.Lock()
+	f.calls++
+	f.mu.Unlock()
+
+	time.Sleep(f.perCall)
+
+	vecs := make([][]float32, len(input))
+	errs := make([]error, len(input))
+	for i := range input {
+		vecs[i] = []float32{0.1, 0.2, 0.3}
+	}
+	return &ent.VectorizationResult{Vector: vecs, Errors: errs},
+		&ent.RateLimits{
+			RemainingTokens:   1000000,
+			RemainingRequests: 0,
+			LimitTokens:       1000000,
+			LimitRequests:     1000000,
+			ResetTokens:       1,
+			ResetRequests:     1,
+		}, nil
+}
+
+func (f *slowFakeClient) VectorizeQuery(ctx context.Context, input []string, config ent.VectorizationConfig,
+) (*ent.VectorizationResult, error) {
+	return nil, nil
+}
+
+// TestObjectBatch_ConcurrentBatchesUseTheirOwnRequestTime enqueues several
+// overlapping batches against a slow client and asserts that none of them
+// fail with "request rate limit exceeded and will not refresh in time"
+// purely because earlier batches kept the worker busy: each job's deadline
+// must be computed from the time it was enqueued, not from "now" by the
+// time the worker finally reaches it.
+//
+// maxBatchTime is sized just above the fake client's fixed 1s
+// ResetRequests but well below the time the last of numBatches jobs spends
+// queued: the fake reports RemainingRequests 0, so every job after the
+// first waits perCall plus a 1s ResetRequests sleep, and the last job is
+// picked up only after roughly 3.4s. A worker that charged that queueing
+// time against maxBatchTime would fail the later jobs; a much larger
+// maxBatchTime would let the test pass either way.
+func TestObjectBatch_ConcurrentBatchesUseTheirOwnRequestTime(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	client := &slowFakeClient{perCall: 100 * time.Millisecond}
+	vec := New(client, 1700*time.Millisecond, logger)
+
+	const numBatches = 5
+
+	var wg sync.WaitGroup
+	errsPerBatch := make([][]error, numBatches)
+	for i := 0; i < numBatches; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			objects := []*models.Object{
+				{Class: "Thing", Properties: map[string]interface{}{"text": "hello world"}},
+			}
+			skip := []bool{false}
+			_, errs := vec.ObjectBatch(context.Background(), objects, skip, fakeClassConfig{})
+			for _, err := range errs {
+				errsPerBatch[i] = append(errsPerBatch[i], err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, errs := range errsPerBatch {
+		for _, err := range errs {
+			require.NoError(t, err, "batch %d should not fail due to a stale deadline", i)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+//                           _       _
+// __      _____  __ ___   ___  __ _| |_ ___
+// \ \ /\ / / _ \/ _` \ \ / / |/ _` | __/ _ \
+//  \ V  V /  __/ (_| |\ V /| | (_| | ||  __/
+//   \_/\_/ \___|\__,_| \_/ |_|\__,_|\__\___|
+//
+//  Copyright © 2016 - 2024 Weaviate B.V. All rights reserved.
+//
+//  CONTACT: hello@weaviate.io
+//
+
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Algorithm selects how a TokenBucket behaves once its budget is
+// exhausted. It is configured per class via the `rateLimitAlgorithm`
+// module setting.
+type Algorithm string
+
+const (
+	// TokenBucketAlgorithm assumes the provider's remaining budget resets
+	// in one jump at ResetTokens, so an item that doesn't currently fit
+	// simply waits for that reset (prorated by how much of the limit it
+	// needs) before being admitted.
+	TokenBucketAlgorithm Algorithm = "tokenBucket"
+
+	// LeakyBucketAlgorithm assumes the provider refills continuously and
+	// prorates the refill for every millisecond elapsed since the last
+	// observation, rather than waiting for the reset window to fully
+	// elapse. This tends to unblock callers sooner on providers that in
+	// fact refill continuously.
+	LeakyBucketAlgorithm Algorithm = "leakyBucket"
+
+	// DrainOverLimitAlgorithm never waits: if a single item is larger than
+	// the remaining budget, it drains the bucket to zero and lets the
+	// caller submit the item anyway, trading a provider-side 429/slowdown
+	// for not stalling the batch. Useful for latency-sensitive classes
+	// that would rather risk a retry than sleep.
+	DrainOverLimitAlgorithm Algorithm = "drainOverLimit"
+)
+
+// ParseAlgorithm validates a `rateLimitAlgorithm` config value, defaulting
+// to TokenBucketAlgorithm for an empty string to preserve the historic
+// behavior of classes that predate this setting.
+func ParseAlgorithm(s string) (Algorithm, error) {
+	switch Algorithm(s) {
+	case "":
+		return TokenBucketAlgorithm, nil
+	case TokenBucketAlgorithm, LeakyBucketAlgorithm, DrainOverLimitAlgorithm:
+		return Algorithm(s), nil
+	default:
+		return "", fmt.Errorf("invalid rateLimitAlgorithm %q", s)
+	}
+}
+
+// TokenBucket is a single-process, per-class view of a provider's rate
+// limit, as reported by its `x-ratelimit-*` response headers. It replaces
+// the ad-hoc sleeping/refill logic that used to live directly in
+// batchWorker. Unlike ClusterLimiter it does not coordinate with other
+// nodes; modules that need cluster-wide enforcement keep a TokenBucket per
+// node and additionally consult a ClusterLimiter, whose Owner on the
+// owning node holds the shared budget.
+//
+// Callers are expected to pack their own batches against Snapshot (as
+// batchWorker does, accumulating items while staying under the remaining
+// budget) and only call Reserve for the case a single item doesn't fit the
+// budget at all, i.e. the batch built so far is empty.
+type TokenBucket struct {
+	algorithm Algorithm
+
+	mu        sync.Mutex
+	state     RateLimits
+	updatedAt time.Time
+}
+
+// NewTokenBucket creates a bucket that has not yet observed any real
+// provider limits (LimitTokens == 0). Callers should keep sending small
+// exploratory requests and feeding the result to Observe until LimitTokens
+// becomes non-zero.
+func NewTokenBucket(algorithm Algorithm) *TokenBucket {
+	return &TokenBucket{algorithm: algorithm}
+}
+
+// Reserve decides what to do about a single item of `tokens` tokens that
+// did not fit into the current batch because it alone exceeds the
+// remaining budget. Depending on the configured Algorithm it either:
+//   - returns how long the caller must wait (bounded by deadline, computed
+//     from requestTime) for enough of the budget to refill, and bumps the
+//     bucket accordingly; Reserve itself does not sleep, or
+//   - drains the bucket to zero and returns a zero wait (DrainOverLimit).
+//
+// A non-nil error means the item can never be sent within deadline and
+// should be failed by the caller.
+func (b *TokenBucket) Reserve(tokens int, requestTime, deadline time.Time) (time.Duration, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.algorithm == DrainOverLimitAlgorithm {
+		b.state.RemainingTokens = 0
+		return 0, nil
+	}
+
+	if b.state.LimitTokens <= 0 || b.state.ResetTokens <= 0 {
+		return 0, fmt.Errorf("text too long for vectorization")
+	}
+
+	var wait time.Duration
+	switch b.algorithm {
+	case LeakyBucketAlgorithm:
+		perMs := float64(b.state.LimitTokens) / float64(b.state.ResetTokens.Milliseconds())
+		deficit := tokens - b.state.RemainingTokens
+		wait = time.Duration(float64(deficit)/perMs) * time.Millisecond
+	default: // TokenBucketAlgorithm
+		fractionOfLimit := float64(tokens) / float64(b.state.LimitTokens)
+		wait = time.Duration(fractionOfLimit*float64(b.state.ResetTokens)) + time.Second
+	}
+
+	// Compare against time.Now(), not requestTime: deadline is anchored to
+	// requestTime (typically requestTime.Add(maxBatchTime)), so judging the
+	// wait from requestTime again would ignore any time already spent
+	// queueing or waiting earlier in the same job, letting a job that has
+	// already burned most of its budget sleep past maxBatchTime anyway.
+	if time.Now().Add(wait).After(deadline) {
+		return 0, fmt.Errorf("text too long for vectorization: cannot wait for token refresh due to time limit")
+	}
+
+	if b.algorithm == LeakyBucketAlgorithm {
+		b.state.RemainingTokens = reserveGrant(tokens)
+	} else {
+		fractionOfLimit := float64(tokens) / float64(b.state.LimitTokens)
+		b.state.RemainingTokens += reserveGrant(int(fractionOfLimit * float64(b.state.LimitTokens)))
+	}
+	return wait, nil
+}
+
+// packingHeadroom mirrors batchWorker's packing check (objects.go), which
+// only adds an item to a vectorizer-batch while tokensInCurrentBatch stays
+// under 95% of RemainingTokens.
+const packingHeadroom = 0.95
+
+// reserveGrant returns how many tokens Reserve should credit the bucket
+// with for an item of `tokens` tokens, once it has decided the item can be
+// admitted. Crediting exactly `tokens` would leave RemainingTokens at
+// precisely the item's size, which batchWorker's packing check above never
+// accepts (it requires strictly less than 95% of RemainingTokens) - so the
+// same item would fail that check again on the very next iteration and
+// loop back into Reserve forever. Padding the grant past the headroom
+// threshold guarantees the packing check passes once Reserve has granted
+// the budget for an item.
+func reserveGrant(tokens int) int {
+	return int(math.Ceil(float64(tokens)/packingHeadroom)) + 1
+}
+
+// refillProrated adds tokens/requests for every millisecond elapsed since
+// updatedAt, capped at the provider's limit. b.mu must be held.
+func (b *TokenBucket) refillProrated(now time.Time) {
+	if b.updatedAt.IsZero() {
+		b.updatedAt = now
+		return
+	}
+	elapsed := now.Sub(b.updatedAt)
+	if elapsed <= 0 {
+		return
+	}
+
+	if b.state.ResetTokens > 0 && b.state.LimitTokens > 0 {
+		perMs := float64(b.state.LimitTokens) / float64(b.state.ResetTokens.Milliseconds())
+		b.state.RemainingTokens += int(perMs * float64(elapsed.Milliseconds()))
+		if b.state.RemainingTokens > b.state.LimitTokens {
+			b.state.RemainingTokens = b.state.LimitTokens
+		}
+	}
+	if b.state.ResetRequests > 0 && b.state.LimitRequests > 0 {
+		perMs := float64(b.state.LimitRequests) / float64(b.state.ResetRequests.Milliseconds())
+		b.state.RemainingRequests += int(perMs * float64(elapsed.Milliseconds()))
+		if b.state.RemainingRequests > b.state.LimitRequests {
+			b.state.RemainingRequests = b.state.LimitRequests
+		}
+	}
+	b.updatedAt = now
+}
+
+// Observe updates the bucket with the limits reported by the provider
+// after a real upstream call.
+func (b *TokenBucket) Observe(limits RateLimits) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = limits
+	b.updatedAt = time.Now()
+}
+
+// Snapshot returns the bucket's current view of the provider's limits, for
+// callers (e.g. batchWorker) that pack their own batches against the
+// remaining budget. For LeakyBucketAlgorithm this first prorates the
+// refill owed since the last observation or Snapshot call.
+func (b *TokenBucket) Snapshot() RateLimits {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.algorithm == LeakyBucketAlgorithm {
+		b.refillProrated(time.Now())
+	}
+	return b.state
+}
@@ -0,0 +1,66 @@
+//                           _       _
+// __      _____  __ ___   ___  __ _| |_ ___
+// \ \ /\ / / _ \/ _` \ \ / / |/ _` | __/ _ \
+//  \ V  V /  __/ (_| |\ V /| | (_| | ||  __/
+//   \_/\_/ \___|\__,_| \_/ |_|\__,_|\__\___|
+//
+//  Copyright © 2016 - 2024 Weaviate B.V. All rights reserved.
+//
+//  CONTACT: hello@weaviate.io
+//
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTokenBucket_ReserveGrantsEnoughHeadroomForPackingCheck reproduces the
+// scenario batchWorker hits when a single item alone doesn't fit the
+// remaining budget: it calls Reserve, then re-checks the item against its
+// own 95%-of-RemainingTokens packing threshold before trying to admit it
+// again. A Reserve that only credits the bucket with exactly the item's
+// token count leaves RemainingTokens pinned at the item's size, which that
+// 95% check never accepts - so the item would never get admitted.
+func TestTokenBucket_ReserveGrantsEnoughHeadroomForPackingCheck(t *testing.T) {
+	b := NewTokenBucket(LeakyBucketAlgorithm)
+	b.Observe(RateLimits{RemainingTokens: 0, LimitTokens: 1000, ResetTokens: time.Minute})
+
+	const tokens = 96
+	_, err := b.Reserve(tokens, time.Now(), time.Now().Add(time.Minute))
+	require.NoError(t, err)
+
+	snap := b.Snapshot()
+	assert.Less(t, float64(tokens), 0.95*float64(snap.RemainingTokens),
+		"RemainingTokens after Reserve must clear batchWorker's 95%% packing threshold, or the item can never be packed")
+}
+
+// TestTokenBucket_ReserveUnblocksPackingWithinBoundedIterations drives the
+// same Snapshot-check-Reserve loop batchWorker runs and asserts it admits
+// the item within a handful of iterations rather than spinning on it
+// forever - the actual failure mode of the bug this guards against.
+func TestTokenBucket_ReserveUnblocksPackingWithinBoundedIterations(t *testing.T) {
+	for _, algorithm := range []Algorithm{LeakyBucketAlgorithm, TokenBucketAlgorithm} {
+		t.Run(string(algorithm), func(t *testing.T) {
+			b := NewTokenBucket(algorithm)
+			b.Observe(RateLimits{RemainingTokens: 0, LimitTokens: 1000, ResetTokens: time.Minute})
+
+			const tokens = 96
+			admitted := false
+			for i := 0; i < 5; i++ {
+				snap := b.Snapshot()
+				if float64(tokens) < 0.95*float64(snap.RemainingTokens) {
+					admitted = true
+					break
+				}
+				_, err := b.Reserve(tokens, time.Now(), time.Now().Add(time.Minute))
+				require.NoError(t, err)
+			}
+			assert.True(t, admitted, "item should clear the packing check within a bounded number of iterations")
+		})
+	}
+}
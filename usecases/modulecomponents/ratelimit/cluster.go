@@ -0,0 +1,105 @@
+//                           _       _
+// __      _____  __ ___   ___  __ _| |_ ___
+// \ \ /\ / / _ \/ _` \ \ / / |/ _` | __/ _ \
+//  \ V  V /  __/ (_| |\ V /| | (_| | ||  __/
+//   \_/\_/ \___|\__,_| \_/ |_|\__,_|\__\___|
+//
+//  Copyright © 2016 - 2024 Weaviate B.V. All rights reserved.
+//
+//  CONTACT: hello@weaviate.io
+//
+
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+// NodeSelector is the subset of Weaviate's cluster membership abstraction
+// that the rate limiter needs: the local node's name and the sorted,
+// currently-alive set of node names to pick a shard owner from. It is
+// satisfied by usecases/cluster.State.
+type NodeSelector interface {
+	LocalName() string
+	AliveNodes() []string
+}
+
+// PeerClient sends Reserve/Observe requests to the node that owns a given
+// bucket. There is no in-tree implementation yet: the original gRPC-backed
+// one depended on generated protobuf bindings for ratelimitpb/ratelimit.proto
+// that were never checked in, so it was removed rather than shipped
+// non-compiling. A production PeerClient needs those bindings regenerated
+// (`make generate-proto`) and a way to resolve a node name to an address,
+// e.g. the same cluster.State used for NodeSelector.
+type PeerClient interface {
+	Reserve(ctx context.Context, node string, key BucketKey, tokens int, deadline time.Time) (Grant, error)
+	Observe(ctx context.Context, node string, key BucketKey, limits RateLimits) error
+}
+
+// ClusterLimiter is the entry point modules use to request tokens before
+// sending a batch upstream. It transparently resolves which node owns the
+// bucket for a key and either serves the request from the local Owner or
+// forwards it to the owning peer.
+type ClusterLimiter struct {
+	nodes NodeSelector
+	peers PeerClient
+	owner *Owner
+}
+
+// NewClusterLimiter builds a ClusterLimiter that shards buckets across the
+// nodes reported by nodes, forwarding non-local requests through peers.
+func NewClusterLimiter(nodes NodeSelector, peers PeerClient) *ClusterLimiter {
+	return &ClusterLimiter{
+		nodes: nodes,
+		peers: peers,
+		owner: NewOwner(),
+	}
+}
+
+// Reserve requests up to tokens tokens for key, blocking until the owning
+// node can grant them or deadline passes.
+func (c *ClusterLimiter) Reserve(ctx context.Context, key BucketKey, tokens int, deadline time.Time) (Grant, error) {
+	owner := c.ownerOf(key)
+	if owner == c.nodes.LocalName() {
+		return c.owner.Reserve(ctx, key, tokens, deadline)
+	}
+	return c.peers.Reserve(ctx, owner, key, tokens, deadline)
+}
+
+// Observe reports provider rate-limit headers observed after a real
+// upstream call so the bucket owner can correct its view of the budget.
+func (c *ClusterLimiter) Observe(ctx context.Context, key BucketKey, limits RateLimits) error {
+	owner := c.ownerOf(key)
+	if owner == c.nodes.LocalName() {
+		c.owner.Observe(key, limits)
+		return nil
+	}
+	return c.peers.Observe(ctx, owner, key, limits)
+}
+
+// ownerOf deterministically picks the node responsible for key by hashing
+// it into the sorted list of alive nodes. Using a pure function of the
+// (key, node-list) pair, rather than e.g. round robin, means every node
+// agrees on the owner without needing to coordinate. The hash is taken
+// modulo the node count, so a membership change moves most keys to a
+// different owner, which rebuilds each bucket from scratch on first use.
+func (c *ClusterLimiter) ownerOf(key BucketKey) string {
+	nodes := c.nodes.AliveNodes()
+	if len(nodes) == 0 {
+		return c.nodes.LocalName()
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(key.String()))
+	idx := h.Sum64() % uint64(len(nodes))
+	return nodes[idx]
+}
+
+// ErrNoNodes reports that cluster membership cannot currently be
+// determined. Nothing in this package returns it: NodeSelector's methods
+// have no error result, and ownerOf falls back to the local node when
+// AliveNodes is empty.
+var ErrNoNodes = fmt.Errorf("ratelimit: no cluster nodes available")
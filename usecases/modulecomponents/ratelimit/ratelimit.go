@@ -0,0 +1,222 @@
+//                           _       _
+// __      _____  __ ___   ___  __ _| |_ ___
+// \ \ /\ / / _ \/ _` \ \ / / |/ _` | __/ _ \
+//  \ V  V /  __/ (_| |\ V /| | (_| | ||  __/
+//   \_/\_/ \___|\__,_| \_/ |_|\__,_|\__\___|
+//
+//  Copyright © 2016 - 2024 Weaviate B.V. All rights reserved.
+//
+//  CONTACT: hello@weaviate.io
+//
+
+// Package ratelimit provides a cluster-wide token-bucket rate limiter for
+// third-party embedding providers (OpenAI, Cohere, HuggingFace, ...).
+//
+// Every node in a Weaviate cluster may vectorize objects against the same
+// provider API key, but the provider enforces a single quota for that key.
+// Instead of each node tracking "RemainingTokens"/"RemainingRequests"
+// locally (which under-counts usage from its peers), one node is elected
+// owner of the budget for a given provider+apiKey+model tuple and every
+// node, including the owner itself, asks that owner for a grant before it
+// is allowed to send a batch upstream.
+//
+// Owner and ClusterLimiter are the cluster-aware building blocks; wiring a
+// given module (text2vec-openai, ...) up to them over the network is done
+// through the PeerClient interface, which this package deliberately leaves
+// transport-agnostic. The previous gRPC-backed implementation was removed
+// because it depended on generated bindings (ratelimitpb/ratelimit.proto
+// run through `make generate-proto`) that were never checked in; a module
+// that wants cluster-wide enforcement needs a PeerClient, generated
+// bindings, and a NodeSelector backed by its cluster.State before it can
+// use ClusterLimiter in place of the single-node TokenBucket in bucket.go.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BucketKey identifies the quota that a provider enforces for a single API
+// key. Two classes that share a provider, API key and model also share a
+// bucket, even if they belong to different collections.
+type BucketKey struct {
+	Provider string
+	APIKey   string
+	Model    string
+}
+
+func (k BucketKey) String() string {
+	return fmt.Sprintf("%s/%s/%s", k.Provider, k.Model, Fingerprint(k.APIKey))
+}
+
+// Fingerprint avoids ever logging or shipping a raw API key, here or in any
+// other identifier (e.g. a vectorizer's own bucket key) that is derived
+// from one.
+func Fingerprint(apiKey string) string {
+	if len(apiKey) <= 8 {
+		return "****"
+	}
+	return apiKey[:4] + "..." + apiKey[len(apiKey)-4:]
+}
+
+// Bucket mirrors the rate limit headers reported by embedding providers.
+type Bucket struct {
+	RemainingTokens   int
+	RemainingRequests int
+	LimitTokens       int
+	LimitRequests     int
+	ResetTokens       time.Duration
+	ResetRequests     time.Duration
+
+	// updatedAt is the owner-local time at which the fields above were last
+	// known to be accurate, either because a grant was made or because a
+	// peer reported fresh provider headers via Observe.
+	updatedAt time.Time
+}
+
+// RateLimits is the subset of provider-reported limits that peers observe
+// after a real upstream call and report back to the bucket owner.
+type RateLimits struct {
+	RemainingTokens   int
+	RemainingRequests int
+	LimitTokens       int
+	LimitRequests     int
+	ResetTokens       time.Duration
+	ResetRequests     time.Duration
+}
+
+// Grant is the result of a successful Reserve call: the caller may send a
+// batch of up to Tokens tokens upstream.
+type Grant struct {
+	Tokens int
+}
+
+// Owner tracks buckets for the keys it owns and serves Reserve/Observe
+// requests, whether they originate locally or from a peer over the wire.
+// It is safe for concurrent use.
+type Owner struct {
+	mu      sync.Mutex
+	buckets map[BucketKey]*ownedBucket
+}
+
+type ownedBucket struct {
+	bucket Bucket
+	// firstSeen is true until the first Reserve or Observe for this key.
+	// The first Reserve is granted in full without checking any budget,
+	// mirroring the single-node behaviour of sending a first request to
+	// learn the limits.
+	firstSeen bool
+}
+
+// NewOwner creates an empty bucket owner. A node runs exactly one Owner,
+// which serves whichever keys the cluster has assigned to it, see
+// ClusterLimiter.
+func NewOwner() *Owner {
+	return &Owner{buckets: make(map[BucketKey]*ownedBucket)}
+}
+
+// Reserve asks the owner for up to `tokens` tokens for key, blocking until
+// either enough tokens are available or deadline is exceeded; past the
+// deadline it returns an error and no grant. The first Reserve for a key
+// never observed is granted in full. Fewer tokens than requested are
+// granted only when the bucket is at its full capacity and still holds
+// less than the request (zero while no limits have been observed yet).
+func (o *Owner) Reserve(ctx context.Context, key BucketKey, tokens int, deadline time.Time) (Grant, error) {
+	for {
+		o.mu.Lock()
+		b := o.bucketLocked(key)
+		if b.firstSeen {
+			// We have never observed this key before: grant the requested
+			// budget unchecked so the caller can make one request and
+			// report back real limits via Observe.
+			b.firstSeen = false
+			o.mu.Unlock()
+			return Grant{Tokens: tokens}, nil
+		}
+
+		refillLocked(b)
+		if b.bucket.RemainingTokens >= tokens || b.bucket.RemainingTokens >= b.bucket.LimitTokens {
+			granted := tokens
+			if granted > b.bucket.RemainingTokens {
+				granted = b.bucket.RemainingTokens
+			}
+			b.bucket.RemainingTokens -= granted
+			o.mu.Unlock()
+			return Grant{Tokens: granted}, nil
+		}
+		o.mu.Unlock()
+
+		if !time.Now().Before(deadline) {
+			return Grant{}, fmt.Errorf("rate limiter: no deadline left to wait for %d tokens for %s", tokens, key)
+		}
+
+		select {
+		case <-ctx.Done():
+			return Grant{}, ctx.Err()
+		case <-time.After(waitStep):
+		}
+	}
+}
+
+// waitStep bounds how long Reserve sleeps between refill checks so that a
+// newly arriving deadline, or a concurrent Observe, is noticed promptly.
+const waitStep = 100 * time.Millisecond
+
+// Observe updates the owner's view of a bucket with limits freshly reported
+// by the provider after a real upstream call, made by any peer holding a
+// grant for key.
+func (o *Owner) Observe(key BucketKey, limits RateLimits) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	b := o.bucketLocked(key)
+	b.firstSeen = false
+	b.bucket.RemainingTokens = limits.RemainingTokens
+	b.bucket.RemainingRequests = limits.RemainingRequests
+	b.bucket.LimitTokens = limits.LimitTokens
+	b.bucket.LimitRequests = limits.LimitRequests
+	b.bucket.ResetTokens = limits.ResetTokens
+	b.bucket.ResetRequests = limits.ResetRequests
+	b.bucket.updatedAt = time.Now()
+}
+
+func (o *Owner) bucketLocked(key BucketKey) *ownedBucket {
+	b, ok := o.buckets[key]
+	if !ok {
+		b = &ownedBucket{firstSeen: true}
+		o.buckets[key] = b
+	}
+	return b
+}
+
+// refillLocked linearly refills RemainingTokens/RemainingRequests based on
+// how much time has passed since the last observation and the reset
+// windows last reported by the provider. o.mu must be held.
+func refillLocked(b *ownedBucket) {
+	if b.bucket.updatedAt.IsZero() {
+		return
+	}
+	elapsed := time.Since(b.bucket.updatedAt)
+
+	if b.bucket.ResetTokens > 0 && b.bucket.LimitTokens > 0 {
+		refill := int(float64(b.bucket.LimitTokens) * float64(elapsed) / float64(b.bucket.ResetTokens))
+		if refill > 0 {
+			b.bucket.RemainingTokens += refill
+			if b.bucket.RemainingTokens > b.bucket.LimitTokens {
+				b.bucket.RemainingTokens = b.bucket.LimitTokens
+			}
+		}
+	}
+	if b.bucket.ResetRequests > 0 && b.bucket.LimitRequests > 0 {
+		refill := int(float64(b.bucket.LimitRequests) * float64(elapsed) / float64(b.bucket.ResetRequests))
+		if refill > 0 {
+			b.bucket.RemainingRequests += refill
+			if b.bucket.RemainingRequests > b.bucket.LimitRequests {
+				b.bucket.RemainingRequests = b.bucket.LimitRequests
+			}
+		}
+	}
+	b.bucket.updatedAt = time.Now()
+}
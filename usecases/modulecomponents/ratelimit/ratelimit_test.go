@@ -0,0 +1,106 @@
+//                           _       _
+// __      _____  __ ___   ___  __ _| |_ ___
+// \ \ /\ / / _ \/ _` \ \ / / |/ _` | __/ _ \
+//  \ V  V /  __/ (_| |\ V /| | (_| | ||  __/
+//   \_/\_/ \___|\__,_| \_/ |_|\__,_|\__\___|
+//
+//  Copyright © 2016 - 2024 Weaviate B.V. All rights reserved.
+//
+//  CONTACT: hello@weaviate.io
+//
+
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOwner_ReserveGrantsExploratoryBudgetOnFirstContact(t *testing.T) {
+	o := NewOwner()
+	key := BucketKey{Provider: "openai", APIKey: "sk-test", Model: "text-embedding-3-small"}
+
+	grant, err := o.Reserve(context.Background(), key, 42, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 42, grant.Tokens, "first contact should grant whatever was asked so the caller can learn real limits")
+}
+
+func TestOwner_ReserveServesFromObservedBudget(t *testing.T) {
+	o := NewOwner()
+	key := BucketKey{Provider: "openai", APIKey: "sk-test", Model: "text-embedding-3-small"}
+
+	// Prime the bucket so Reserve no longer takes the first-contact branch.
+	o.Observe(key, RateLimits{RemainingTokens: 100, LimitTokens: 1000, ResetTokens: time.Minute})
+
+	grant, err := o.Reserve(context.Background(), key, 60, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 60, grant.Tokens)
+}
+
+// TestOwner_ReserveWaitsForRefillThenGrantsFullRequest covers the case a
+// request exceeds the currently observed budget but not the limit: Reserve
+// must block, refilling via waitStep polling, until enough has accrued to
+// serve the request in full - it does not hand back a partial grant the
+// way a naive "give whatever's left" implementation would.
+func TestOwner_ReserveWaitsForRefillThenGrantsFullRequest(t *testing.T) {
+	o := NewOwner()
+	key := BucketKey{Provider: "openai", APIKey: "sk-test", Model: "text-embedding-3-small"}
+	o.Observe(key, RateLimits{RemainingTokens: 10, LimitTokens: 1000, ResetTokens: 50 * time.Millisecond})
+
+	grant, err := o.Reserve(context.Background(), key, 200, time.Now().Add(2*time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 200, grant.Tokens)
+}
+
+// TestOwner_ReserveCapsGrantAtLimitWhenRequestExceedsCapacity covers the
+// "already at full capacity" branch: once RemainingTokens reaches
+// LimitTokens, Reserve stops waiting for further refill and instead grants
+// as much of the request as the bucket currently holds, capped at that
+// capacity, rather than waiting for a refill that will never arrive.
+func TestOwner_ReserveCapsGrantAtLimitWhenRequestExceedsCapacity(t *testing.T) {
+	o := NewOwner()
+	key := BucketKey{Provider: "openai", APIKey: "sk-test", Model: "text-embedding-3-small"}
+	o.Observe(key, RateLimits{RemainingTokens: 1000, LimitTokens: 1000, ResetTokens: time.Minute})
+
+	grant, err := o.Reserve(context.Background(), key, 5000, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 1000, grant.Tokens, "grant should be capped at the bucket's full capacity")
+}
+
+func TestOwner_ReserveFailsOncePastDeadline(t *testing.T) {
+	o := NewOwner()
+	key := BucketKey{Provider: "openai", APIKey: "sk-test", Model: "text-embedding-3-small"}
+	o.Observe(key, RateLimits{RemainingTokens: 0, LimitTokens: 1000, ResetTokens: time.Hour})
+
+	_, err := o.Reserve(context.Background(), key, 500, time.Now().Add(-time.Second))
+	assert.Error(t, err)
+}
+
+func TestOwner_ReserveRefillsOverTime(t *testing.T) {
+	o := NewOwner()
+	key := BucketKey{Provider: "openai", APIKey: "sk-test", Model: "text-embedding-3-small"}
+	o.Observe(key, RateLimits{RemainingTokens: 0, LimitTokens: 1000, ResetTokens: 100 * time.Millisecond})
+
+	grant, err := o.Reserve(context.Background(), key, 500, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.Greater(t, grant.Tokens, 0, "the bucket should have refilled at least partially while Reserve waited")
+}
+
+func TestOwner_ObserveIsIsolatedPerKey(t *testing.T) {
+	o := NewOwner()
+	a := BucketKey{Provider: "openai", APIKey: "sk-a", Model: "text-embedding-3-small"}
+	b := BucketKey{Provider: "openai", APIKey: "sk-b", Model: "text-embedding-3-small"}
+
+	o.Observe(a, RateLimits{RemainingTokens: 10, LimitTokens: 10})
+	o.Observe(b, RateLimits{RemainingTokens: 999, LimitTokens: 999})
+
+	// Asking a for more than its own capacity is capped at a's 10 tokens,
+	// not served from b's 999.
+	grant, err := o.Reserve(context.Background(), a, 20, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 10, grant.Tokens)
+}